@@ -0,0 +1,7 @@
+package multicast
+
+import "errors"
+
+// ErrBPFNotSupported is returned by SetBPF on platforms where attaching a
+// classic BPF filter to a socket (SO_ATTACH_FILTER) is not supported.
+var ErrBPFNotSupported = errors.New("multicast: SetBPF not supported on this platform")
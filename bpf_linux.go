@@ -0,0 +1,56 @@
+//go:build linux
+
+package multicast
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// SetBPF compiles filter and attaches it to the underlying socket via
+// SO_ATTACH_FILTER, so the kernel drops packets that fail the filter before
+// they ever wake up userspace. This is useful for busy groups such as
+// 224.0.0.251:5353, where most receivers only care about a subset of
+// traffic; see mdns.FilterByQType for a worked example.
+func (c *UDPConn) SetBPF(filter []bpf.Instruction) error {
+	if len(filter) == 0 {
+		return errors.New("multicast: SetBPF requires at least one instruction")
+	}
+
+	raw, err := bpf.Assemble(filter)
+	if err != nil {
+		return fmt.Errorf("multicast: failed to assemble BPF filter: %w", err)
+	}
+
+	sockFilter := make([]unix.SockFilter, len(raw))
+	for i, ins := range raw {
+		sockFilter[i] = unix.SockFilter{
+			Code: ins.Op,
+			Jt:   ins.Jt,
+			Jf:   ins.Jf,
+			K:    ins.K,
+		}
+	}
+
+	prog := unix.SockFprog{
+		Len:    uint16(len(sockFilter)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&sockFilter[0])),
+	}
+
+	rc, err := c.UDPConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var setErr error
+	if err := rc.Control(func(fd uintptr) {
+		setErr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog)
+	}); err != nil {
+		return err
+	}
+	return setErr
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package multicast
+
+import "golang.org/x/net/bpf"
+
+// SetBPF returns ErrBPFNotSupported: SO_ATTACH_FILTER is Linux-only.
+func (c *UDPConn) SetBPF(filter []bpf.Instruction) error {
+	return ErrBPFNotSupported
+}
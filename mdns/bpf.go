@@ -0,0 +1,70 @@
+package mdns
+
+import "golang.org/x/net/bpf"
+
+// maxQNameLabels bounds how many DNS name labels the filter built by
+// FilterByQType will walk before giving up and dropping the packet. 16
+// labels comfortably covers real mDNS query names such as
+// "_http._tcp.local." (3 labels) and fully-qualified instance names.
+const maxQNameLabels = 16
+
+// udpHeaderSize is the fixed 8-byte UDP header. A classic BPF filter
+// attached via SO_ATTACH_FILTER to a SOCK_DGRAM socket sees each packet
+// starting at this header, not at the UDP payload, so every offset below
+// is measured from here rather than from the start of the DNS message.
+const udpHeaderSize = 8
+
+// dnsHeaderSize is the fixed 12-byte DNS message header preceding the
+// question section.
+const dnsHeaderSize = 12
+
+// qnameOffset is the offset of the start of the DNS question's QNAME, as
+// seen by the socket filter.
+const qnameOffset = udpHeaderSize + dnsHeaderSize
+
+// instructionsPerLabel is how many BPF instructions each loop iteration in
+// FilterByQType emits; skip distances below are computed in terms of it.
+const instructionsPerLabel = 5
+
+// FilterByQType builds a BPF program, for use with
+// multicast.UDPConn.SetBPF, that accepts only UDP payloads whose (first)
+// DNS question has one of qtypes and drops everything else in the kernel.
+// It walks the variable-length QNAME using BPF's indirect addressing mode
+// (the X register plus a constant offset) to find the fixed-size QTYPE
+// field that follows it, the same technique classic BPF programs use to
+// skip variable-length IP option headers.
+func FilterByQType(qtypes ...uint16) []bpf.Instruction {
+	ins := []bpf.Instruction{
+		bpf.LoadConstant{Dst: bpf.RegX, Val: qnameOffset},
+	}
+
+	for i := 0; i < maxQNameLabels; i++ {
+		remaining := maxQNameLabels - i - 1
+		ins = append(ins,
+			bpf.LoadIndirect{Off: 0, Size: 1}, // A = label length at X
+			bpf.JumpIf{ // terminator (length 0): skip straight to the QTYPE load
+				Cond:     bpf.JumpEqual,
+				Val:      0,
+				SkipTrue: uint8(4 + instructionsPerLabel*remaining),
+			},
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},                // A = len + X
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1}, // A = len + X + 1
+			bpf.TAX{}, // X = offset of next label
+		)
+	}
+
+	ins = append(ins, bpf.RetConstant{Val: 0})           // no terminator within maxQNameLabels: drop
+	ins = append(ins, bpf.LoadIndirect{Off: 1, Size: 2}) // A = QTYPE
+
+	for i, qt := range qtypes {
+		remaining := uint8(len(qtypes) - i - 1)
+		ins = append(ins, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(qt), SkipTrue: remaining + 1})
+	}
+
+	ins = append(ins,
+		bpf.RetConstant{Val: 0},     // no match: drop
+		bpf.RetConstant{Val: 65535}, // match: accept the whole packet
+	)
+
+	return ins
+}
@@ -0,0 +1,124 @@
+// Package mdns implements mDNS/DNS-SD (RFC 6762/6763) service discovery on
+// top of multicast.UDPConn. Its sockets are bound with SO_REUSEADDR set
+// before bind(2) via multicast.ListenConfig. Responders and resolvers join
+// the interfaces present when they are created and do not run
+// WatchInterfaces, so interfaces that appear later are not joined.
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/oosawy/multicast"
+)
+
+var (
+	addrV4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	addrV6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// Service describes a local service instance to advertise over mDNS/DNS-SD,
+// as defined by RFC 6763.
+type Service struct {
+	// Instance is the service instance name, e.g. "My Printer".
+	Instance string
+	// Type is the DNS-SD service type, e.g. "_http._tcp".
+	Type string
+	// Domain is the domain the service is advertised in, usually "local".
+	Domain string
+	// Host is the hostname the service resolves to, e.g. "myhost.local.".
+	Host string
+	// Port is the TCP/UDP port the service listens on.
+	Port uint16
+	// Text holds TXT record key=value attributes.
+	Text []string
+	// IPs are the addresses Host resolves to.
+	IPs []net.IP
+}
+
+// ServiceEntry describes a service instance discovered by Resolver.Browse.
+type ServiceEntry struct {
+	Instance string
+	Type     string
+	Domain   string
+	Host     string
+	Port     uint16
+	Text     []string
+	IPs      []net.IP
+	// TTL is the remaining time-to-live, in seconds, reported for the
+	// instance's records.
+	TTL uint32
+}
+
+// instanceFQDN returns the fully-qualified "Instance.Type.Domain." name.
+func (s Service) instanceFQDN() string {
+	return fmt.Sprintf("%s.%s.%s.", s.Instance, s.Type, s.Domain)
+}
+
+// typeFQDN returns the fully-qualified "Type.Domain." name used as the PTR
+// query name for this service.
+func (s Service) typeFQDN() string {
+	return fmt.Sprintf("%s.%s.", s.Type, s.Domain)
+}
+
+// hostFQDN returns the fully-qualified host name, defaulting to
+// "Instance.Domain." when Host is unset.
+func (s Service) hostFQDN() string {
+	if s.Host != "" {
+		return s.Host
+	}
+	return fmt.Sprintf("%s.%s.", s.Instance, s.Domain)
+}
+
+// listen opens dual-stack multicast connections bound to port 5353 on the
+// IPv4 and IPv6 wildcard addresses, and joins 224.0.0.251 and ff02::fb
+// respectively on every multicast-capable interface. At least one of the
+// two must succeed; a host without IPv6 multicast support, for instance,
+// still gets a usable IPv4-only connection pair.
+func listen() (conn4, conn6 *multicast.UDPConn, err error) {
+	cfg := &multicast.ListenConfig{Reuse: true}
+	conn4, err4 := cfg.Listen("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 5353})
+	if err4 == nil {
+		if err := joinAll(conn4, addrV4); err != nil {
+			conn4.Close()
+			conn4, err4 = nil, err
+		}
+	}
+
+	conn6, err6 := cfg.Listen("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: 5353})
+	if err6 == nil {
+		if err := joinAll(conn6, addrV6); err != nil {
+			conn6.Close()
+			conn6, err6 = nil, err
+		}
+	}
+
+	if conn4 == nil && conn6 == nil {
+		return nil, nil, fmt.Errorf("mdns: failed to listen on udp4 (%v) and udp6 (%v)", err4, err6)
+	}
+	return conn4, conn6, nil
+}
+
+// joinAll joins gaddr on every interface conn is already listening on.
+func joinAll(conn *multicast.UDPConn, gaddr *net.UDPAddr) error {
+	var errs []error
+	for _, ifi := range conn.Interfaces() {
+		ifi := ifi
+		if err := conn.JoinMulticastGroup(&ifi, gaddr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func closeConns(conn4, conn6 *multicast.UDPConn) error {
+	var errs []error
+	if conn4 != nil {
+		errs = append(errs, conn4.Close())
+	}
+	if conn6 != nil {
+		errs = append(errs, conn6.Close())
+	}
+	return errors.Join(errs...)
+}
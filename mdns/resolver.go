@@ -0,0 +1,241 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/oosawy/multicast"
+)
+
+// maxQueryInterval is the RFC 6762 §5.2 cap on the exponential backoff
+// between repeated queries in a continuous Browse.
+const maxQueryInterval = 60 * time.Minute
+
+// Resolver sends mDNS queries and parses responses into ServiceEntry
+// values.
+type Resolver struct {
+	conn4, conn6 *multicast.UDPConn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewResolver creates a Resolver listening on both 224.0.0.251:5353 and
+// ff02::fb:5353 across every multicast-capable interface.
+func NewResolver() (*Resolver, error) {
+	conn4, conn6, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{conn4: conn4, conn6: conn6, closed: make(chan struct{})}, nil
+}
+
+// Close stops any in-flight Browse calls and releases the underlying
+// connections.
+func (r *Resolver) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		err = closeConns(r.conn4, r.conn6)
+	})
+	return err
+}
+
+// Browse queries for instances of service (e.g. "_http._tcp.local.") and
+// sends every ServiceEntry it discovers to results. It re-queries with
+// exponential backoff starting at one second, as required by RFC 6762
+// §5.2, so results keeps reporting instances that join after Browse
+// starts. Browse blocks until ctx is canceled or Close is called; to do a
+// one-shot lookup, cancel ctx after the first result is read from results.
+func (r *Resolver) Browse(ctx context.Context, service string, results chan<- ServiceEntry) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	msgs := make(chan *dns.Msg, 16)
+	var wg sync.WaitGroup
+	for _, conn := range []*multicast.UDPConn{r.conn4, r.conn6} {
+		if conn == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(conn *multicast.UDPConn) {
+			defer wg.Done()
+			r.readResponses(ctx, conn, msgs)
+		}(conn)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.query(ctx, service)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(msgs)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.closed:
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			for _, entry := range entriesFromMsg(msg) {
+				select {
+				case results <- entry:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+}
+
+// query repeatedly sends a PTR query for service with exponential backoff
+// until ctx is canceled.
+func (r *Resolver) query(ctx context.Context, service string) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(service), dns.TypePTR)
+	msg.RecursionDesired = false
+
+	buf, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	interval := time.Second
+	for {
+		if r.conn4 != nil {
+			r.conn4.WriteToMulticast(buf, addrV4)
+		}
+		if r.conn6 != nil {
+			r.conn6.WriteToMulticast(buf, addrV6)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.closed:
+			return
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > maxQueryInterval {
+			interval = maxQueryInterval
+		}
+	}
+}
+
+// readResponses reads mDNS responses from conn and forwards the parsed
+// messages to msgs until ctx is canceled.
+func (r *Resolver) readResponses(ctx context.Context, conn *multicast.UDPConn, msgs chan<- *dns.Msg) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, _, err := conn.ReadFromMulticast(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.closed:
+				return
+			default:
+				continue
+			}
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+
+		select {
+		case msgs <- msg:
+		case <-ctx.Done():
+			return
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// entriesFromMsg assembles ServiceEntry values from the records in msg's
+// Answer and Additional sections.
+func entriesFromMsg(msg *dns.Msg) []ServiceEntry {
+	rrs := append(append([]dns.RR{}, msg.Answer...), msg.Extra...)
+
+	entries := map[string]*ServiceEntry{}
+	entryFor := func(name string) *ServiceEntry {
+		if e, ok := entries[name]; ok {
+			return e
+		}
+		e := &ServiceEntry{}
+		entries[name] = e
+		return e
+	}
+
+	hostIPs := map[string][]net.IP{}
+
+	for _, rr := range rrs {
+		switch rec := rr.(type) {
+		case *dns.PTR:
+			e := entryFor(rec.Ptr)
+			e.Instance, e.Type, e.Domain = splitInstanceFQDN(rec.Ptr)
+			e.TTL = rec.Hdr.Ttl
+		case *dns.SRV:
+			e := entryFor(rec.Hdr.Name)
+			e.Host = rec.Target
+			e.Port = rec.Port
+		case *dns.TXT:
+			e := entryFor(rec.Hdr.Name)
+			e.Text = rec.Txt
+		case *dns.A:
+			hostIPs[rec.Hdr.Name] = append(hostIPs[rec.Hdr.Name], rec.A)
+		case *dns.AAAA:
+			hostIPs[rec.Hdr.Name] = append(hostIPs[rec.Hdr.Name], rec.AAAA)
+		}
+	}
+
+	var out []ServiceEntry
+	for _, e := range entries {
+		if e.Instance == "" {
+			continue
+		}
+		e.IPs = hostIPs[e.Host]
+		out = append(out, *e)
+	}
+	return out
+}
+
+// splitInstanceFQDN splits an "Instance.Type.Domain." PTR target back into
+// its three components.
+func splitInstanceFQDN(fqdn string) (instance, typ, domain string) {
+	labels := dns.SplitDomainName(fqdn)
+	if len(labels) < 3 {
+		return fqdn, "", ""
+	}
+	n := len(labels)
+	domain = labels[n-1]
+	typ = labels[n-3] + "." + labels[n-2]
+	instance = joinLabels(labels[:n-3])
+	return instance, typ, domain
+}
+
+func joinLabels(labels []string) string {
+	out := ""
+	for i, l := range labels {
+		if i > 0 {
+			out += "."
+		}
+		out += l
+	}
+	return out
+}
@@ -0,0 +1,189 @@
+package mdns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/oosawy/multicast"
+)
+
+const defaultTTL = 120
+
+// Responder answers mDNS queries for a fixed set of local Services. It
+// listens on both 224.0.0.251:5353 and ff02::fb:5353 across every
+// multicast-capable interface, and answers each query only on the interface
+// it arrived on using the per-packet ControlMessage from
+// multicast.UDPConn.ReadFromMulticast.
+type Responder struct {
+	services []Service
+
+	conn4, conn6 *multicast.UDPConn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewResponder creates a Responder advertising services and starts
+// answering queries for them in the background. Call Close to stop.
+func NewResponder(services ...Service) (*Responder, error) {
+	conn4, conn6, err := listen()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Responder{
+		services: services,
+		conn4:    conn4,
+		conn6:    conn6,
+		closed:   make(chan struct{}),
+	}
+
+	if conn4 != nil {
+		go r.serve(conn4)
+	}
+	if conn6 != nil {
+		go r.serve(conn6)
+	}
+
+	return r, nil
+}
+
+// Close stops answering queries and releases the underlying connections.
+func (r *Responder) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		err = closeConns(r.conn4, r.conn6)
+	})
+	return err
+}
+
+func (r *Responder) serve(conn *multicast.UDPConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, src, cm, err := conn.ReadFromMulticast(buf)
+		if err != nil {
+			select {
+			case <-r.closed:
+				return
+			default:
+				continue
+			}
+		}
+
+		if cm == nil {
+			continue
+		}
+
+		query := new(dns.Msg)
+		if err := query.Unpack(buf[:n]); err != nil || query.Response {
+			continue
+		}
+
+		r.answer(conn, query, src, cm)
+	}
+}
+
+// answer builds and sends the answer for query back to src, the interface
+// named by cm (the interface the query arrived on) having been surfaced by
+// ReadFromMulticast so the reply can go out as a unicast packet over the
+// same interface rather than being multicast to every joined interface. It
+// skips records the querier already knows about, per its known-answer
+// list.
+func (r *Responder) answer(conn *multicast.UDPConn, query *dns.Msg, src *net.UDPAddr, cm *multicast.ControlMessage) {
+	for _, q := range query.Question {
+		for _, svc := range r.services {
+			rr := r.answerRR(svc, q)
+			if rr == nil || knownAnswer(query.Answer, rr) {
+				continue
+			}
+
+			if query.Truncated {
+				time.Sleep(400*time.Millisecond + time.Duration(len(svc.Instance)%100)*time.Millisecond)
+			}
+
+			resp := new(dns.Msg)
+			resp.Response = true
+			resp.Authoritative = true
+			resp.Answer = append(resp.Answer, rr)
+
+			buf, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+
+			if err := conn.WriteToInterface(buf, src, cm.IfIndex); err != nil {
+				continue
+			}
+		}
+	}
+}
+
+// answerRR returns the resource record that answers q for svc, or nil if
+// svc does not answer q.
+func (r *Responder) answerRR(svc Service, q dns.Question) dns.RR {
+	ttl := uint32(defaultTTL)
+
+	switch q.Qtype {
+	case dns.TypePTR:
+		if q.Name != svc.typeFQDN() {
+			return nil
+		}
+		return &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: svc.instanceFQDN(),
+		}
+	case dns.TypeSRV:
+		if q.Name != svc.instanceFQDN() {
+			return nil
+		}
+		return &dns.SRV{
+			Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+			Priority: 0,
+			Weight:   0,
+			Port:     svc.Port,
+			Target:   svc.hostFQDN(),
+		}
+	case dns.TypeTXT:
+		if q.Name != svc.instanceFQDN() {
+			return nil
+		}
+		return &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: svc.Text,
+		}
+	case dns.TypeA, dns.TypeAAAA:
+		if q.Name != svc.hostFQDN() {
+			return nil
+		}
+		for _, ip := range svc.IPs {
+			if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+				return &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip4}
+			}
+			if ip.To4() == nil && q.Qtype == dns.TypeAAAA {
+				return &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: ip}
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// knownAnswer reports whether the querier's known-answer list already
+// contains rr with at least half its original TTL remaining, per RFC 6762
+// §7.1, in which case the responder must suppress its answer.
+func knownAnswer(known []dns.RR, rr dns.RR) bool {
+	for _, k := range known {
+		if !dns.IsDuplicate(k, rr) {
+			continue
+		}
+		if k.Header().Ttl >= rr.Header().Ttl/2 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package multicast
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// interfaceWatchInterval is how often WatchInterfaces diffs net.Interfaces()
+// against the interfaces already joined.
+const interfaceWatchInterval = 5 * time.Second
+
+// interfaceEventBacklog bounds how many undelivered events WatchInterfaces
+// will hold for a caller that isn't keeping up, so that a caller who
+// discards the channel per its documented contract cannot wedge the
+// watcher goroutine.
+const interfaceEventBacklog = 32
+
+// InterfaceEventType describes whether a WatchInterfaces event is a join or
+// a leave.
+type InterfaceEventType int
+
+const (
+	// InterfaceJoined reports that iface appeared and Group was joined on it.
+	InterfaceJoined InterfaceEventType = iota
+	// InterfaceLeft reports that iface disappeared and Group was left on it.
+	InterfaceLeft
+)
+
+// InterfaceEvent reports a join or leave performed by WatchInterfaces.
+type InterfaceEvent struct {
+	Type  InterfaceEventType
+	Iface net.Interface
+	Group net.UDPAddr
+	// Err is non-nil if the join/leave call failed.
+	Err error
+}
+
+// WatchInterfaces starts a background goroutine that periodically diffs
+// net.Interfaces() against the interfaces this connection has joined, and
+// automatically calls JoinMulticastGroup on newly-appeared multicast-capable
+// interfaces and LeaveMulticastGroup on ones that disappear, for every group
+// the connection has ever joined via JoinMulticastGroup. An interface that
+// keeps its name is left and rejoined when its addrFingerprint changes,
+// that is, when its flags or its index differ from those recorded at join
+// time. An interface re-addressed in place, with the same index and flags,
+// is not detected as changed and is not rejoined. This makes long-lived
+// multicast listeners self-healing across link up/down and Wi-Fi/VPN
+// toggles.
+//
+// The returned channel reports every join/leave WatchInterfaces performs.
+// It is buffered, and a send that would block because a caller isn't
+// reading is dropped rather than blocking the watcher goroutine, so callers
+// that don't care may simply discard it. Callers that want to observe every
+// event must drain it promptly, since a sufficiently slow reader can still
+// lose events once the buffer fills. The goroutine exits when ctx is
+// canceled.
+func (c *UDPConn) WatchInterfaces(ctx context.Context) <-chan InterfaceEvent {
+	events := make(chan InterfaceEvent, interfaceEventBacklog)
+
+	go func() {
+		defer close(events)
+
+		ticker := time.NewTicker(interfaceWatchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.diffInterfaces(events)
+			}
+		}
+	}()
+
+	return events
+}
+
+// diffInterfaces joins newly-appeared multicast-capable interfaces, leaves
+// ones that have disappeared, and rejoins ones whose recorded and current
+// snapshots (same name) have a different addrFingerprint, reporting each
+// attempt on events. Sends that would block because the
+// caller isn't reading are dropped; see WatchInterfaces.
+func (c *UDPConn) diffInterfaces(events chan<- InterfaceEvent) {
+	current, err := multicastInterfaces()
+	if err != nil {
+		return
+	}
+
+	known := make(map[string]net.Interface)
+	for _, ifi := range c.Interfaces() {
+		known[ifi.Name] = ifi
+	}
+	seen := make(map[string]net.Interface, len(current))
+	for _, ifi := range current {
+		seen[ifi.Name] = ifi
+	}
+	groups := c.Groups()
+
+	for name, ifi := range seen {
+		old, ok := known[name]
+		if ok && addrFingerprint(old) == addrFingerprint(ifi) {
+			continue
+		}
+		if ok {
+			c.rejoinGroups(events, old, ifi, groups)
+			continue
+		}
+		c.joinGroups(events, ifi, groups)
+	}
+
+	for name, ifi := range known {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		c.leaveGroups(events, ifi, groups)
+	}
+}
+
+// joinGroups calls JoinMulticastGroup for every group in groups on ifi,
+// reporting each attempt on events.
+func (c *UDPConn) joinGroups(events chan<- InterfaceEvent, ifi net.Interface, groups []net.UDPAddr) {
+	for _, gaddr := range groups {
+		err := c.JoinMulticastGroup(&ifi, &gaddr)
+		sendEvent(events, InterfaceEvent{Type: InterfaceJoined, Iface: ifi, Group: gaddr, Err: err})
+	}
+}
+
+// leaveGroups calls LeaveMulticastGroup for every group in groups on ifi,
+// reporting each attempt on events.
+func (c *UDPConn) leaveGroups(events chan<- InterfaceEvent, ifi net.Interface, groups []net.UDPAddr) {
+	for _, gaddr := range groups {
+		err := c.LeaveMulticastGroup(&ifi, &gaddr)
+		sendEvent(events, InterfaceEvent{Type: InterfaceLeft, Iface: ifi, Group: gaddr, Err: err})
+	}
+}
+
+// rejoinGroups leaves groups on oldIfi and rejoins them on newIfi, for an
+// interface that kept its name but whose addrFingerprint changed. Both the
+// leave and the join are reported on events.
+func (c *UDPConn) rejoinGroups(events chan<- InterfaceEvent, oldIfi, newIfi net.Interface, groups []net.UDPAddr) {
+	c.leaveGroups(events, oldIfi, groups)
+	c.joinGroups(events, newIfi, groups)
+}
+
+// sendEvent delivers ev on events without blocking, dropping it if the
+// channel's buffer is full; see WatchInterfaces.
+func sendEvent(events chan<- InterfaceEvent, ev InterfaceEvent) {
+	select {
+	case events <- ev:
+	default:
+	}
+}
+
+// addrFingerprint summarizes ifi's flags and the addresses currently
+// assigned to ifi.Index. ifi.Addrs() reads the live address table, so two
+// snapshots of an interface with the same index and flags give the same
+// fingerprint; a recorded snapshot differs from the current one only when
+// the flags changed or the interface came back under a new index.
+func addrFingerprint(ifi net.Interface) string {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return fmt.Sprintf("%d|error", ifi.Flags)
+	}
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+	sort.Strings(strs)
+	return fmt.Sprintf("%d|%s", ifi.Flags, strings.Join(strs, ","))
+}
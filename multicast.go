@@ -1,13 +1,18 @@
 package multicast
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"runtime"
+	"sync"
+	"syscall"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+
+	"github.com/oosawy/multicast/reuse"
 )
 
 // UDPConn is a UDP connection configured for multicast communication.
@@ -18,12 +23,33 @@ type UDPConn struct {
 
 	// network is "udp4" or "udp6".
 	network string
-	// ifaces lists interfaces joined to the multicast group.
-	ifaces []net.Interface
 	// ipv4conn is non-nil when network == "udp4".
 	ipv4conn *ipv4.PacketConn
 	// ipv6conn is non-nil when network == "udp6".
 	ipv6conn *ipv6.PacketConn
+
+	// mu guards ifaces, groups and memberships, which WatchInterfaces
+	// mutates from a background goroutine.
+	mu sync.Mutex
+	// ifaces lists the distinct interfaces this connection sends on: those
+	// it has joined at least one multicast group on, or, when Listen bound
+	// a non-multicast address, the configured interfaces it started with.
+	ifaces []net.Interface
+	// groups lists the distinct multicast group addresses ever joined on
+	// this connection, used by WatchInterfaces to rejoin on new interfaces.
+	// LeaveMulticastGroup does not remove entries from it.
+	groups []net.UDPAddr
+	// memberships tracks which (interface, group) pairs are currently
+	// joined, so JoinMulticastGroup keeps ifaces/groups deduplicated and
+	// LeaveMulticastGroup drops an interface from ifaces only once no group
+	// is joined on it.
+	memberships []membership
+}
+
+// membership records a single joined (interface, group) pair.
+type membership struct {
+	IfaceName string
+	Group     net.UDPAddr
 }
 
 // ListenMulticastUDPIfaces listens for multicast on the provided address and
@@ -33,7 +59,43 @@ type UDPConn struct {
 // If ifaces is nil, it will use all multicast-capable interfaces.
 // The addr argument specifies the socket to bind to.
 // It returns a *UDPConn ready for multicast reads/writes.
+//
+// It is equivalent to (&ListenConfig{Interfaces: ifaces}).Listen(network, addr).
 func ListenMulticastUDPIfaces(network string, ifaces []net.Interface, addr *net.UDPAddr) (*UDPConn, error) {
+	return (&ListenConfig{Interfaces: ifaces}).Listen(network, addr)
+}
+
+// ListenConfig configures how a multicast UDPConn is listened and bound.
+//
+// Reuse and ReusePort are applied inside net.ListenConfig.Control before
+// bind(2) runs, rather than on an already-bound socket. That ordering is required on
+// Linux and the BSDs for a second process to bind the same group:port, which
+// is how multiple independent mDNS/SSDP/SAP daemons on the same host can
+// concurrently receive the same multicast stream.
+type ListenConfig struct {
+	// Reuse sets SO_REUSEADDR on the socket before binding.
+	Reuse bool
+	// ReusePort sets SO_REUSEPORT on the socket before binding, on
+	// platforms where it is supported.
+	ReusePort bool
+	// Loopback, if non-nil, overrides whether outbound multicast packets
+	// are looped back to local sockets. Left nil to keep the platform
+	// default.
+	Loopback *bool
+	// TTL sets the multicast TTL (IPv4) or hop limit (IPv6) for outbound
+	// packets. Zero leaves the platform default in place.
+	TTL int
+	// Interfaces lists the network interfaces to join multicast groups on.
+	// A nil slice joins every multicast-capable interface.
+	Interfaces []net.Interface
+}
+
+// Listen listens for multicast on addr using the options in cfg, joining
+// multicast groups on cfg.Interfaces (or every multicast-capable interface
+// if cfg.Interfaces is nil).
+//
+// It accepts "udp4" or "udp6" for the network argument.
+func (cfg *ListenConfig) Listen(network string, addr *net.UDPAddr) (*UDPConn, error) {
 	if addr == nil {
 		return nil, errors.New("multicast: addr cannot be nil")
 	}
@@ -44,14 +106,39 @@ func ListenMulticastUDPIfaces(network string, ifaces []net.Interface, addr *net.
 		return nil, fmt.Errorf("network must be either 'udp4' or 'udp6': %s", network)
 	}
 
-	udpConn, err := net.ListenUDP(network, addr)
+	var controlErr error
+	lc := net.ListenConfig{
+		Control: func(_, _ string, rc syscall.RawConn) error {
+			return rc.Control(func(fd uintptr) {
+				if cfg.Reuse {
+					if err := reuse.ReuseAddr(fd); err != nil {
+						controlErr = errors.Join(controlErr, err)
+					}
+				}
+				if cfg.ReusePort {
+					if err := reuse.ReusePort(fd); err != nil && !errors.Is(err, reuse.ErrReusePortNotSupported) {
+						controlErr = errors.Join(controlErr, err)
+					}
+				}
+			})
+		},
+	}
+
+	pc, err := lc.ListenPacket(context.Background(), network, addr.String())
 	if err != nil {
 		return nil, err
 	}
+	if controlErr != nil {
+		pc.Close()
+		return nil, controlErr
+	}
+	udpConn := pc.(*net.UDPConn)
 
+	ifaces := cfg.Interfaces
 	if ifaces == nil {
 		ifaces, err = multicastInterfaces()
 		if err != nil {
+			udpConn.Close()
 			return nil, fmt.Errorf("multicast: failed to get multicast interfaces: %w", err)
 		}
 	}
@@ -68,15 +155,36 @@ func ListenMulticastUDPIfaces(network string, ifaces []net.Interface, addr *net.
 	conn := &UDPConn{
 		UDPConn:  *udpConn,
 		network:  network,
-		ifaces:   ifaces,
 		ipv4conn: v4PkConn,
 		ipv6conn: v6PkConn,
 	}
 
-	ok, err := conn.joinIfaces(ifaces, addr)
-	if !ok && err != nil {
-		conn.Close()
-		return nil, err
+	// addr is also treated as the group to join on every interface, for
+	// backwards compatibility with callers that bind directly to the
+	// group address. A plain bind address (e.g. the wildcard used to
+	// listen before joining an explicit group via JoinMulticastGroup) is
+	// not itself a multicast group, so there is nothing to join.
+	if addr.IP.IsMulticast() {
+		ok, err := conn.joinIfaces(ifaces, addr)
+		if !ok && err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else {
+		conn.ifaces = ifaces
+	}
+
+	if cfg.Loopback != nil {
+		if err := conn.SetMulticastLoopback(*cfg.Loopback); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if cfg.TTL != 0 {
+		if err := conn.SetMulticastTTL(cfg.TTL); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 
 	return conn, nil
@@ -129,10 +237,140 @@ func (c *UDPConn) JoinMulticastGroup(iface *net.Interface, gaddr *net.UDPAddr) e
 		panic("unreachable")
 	}
 
-	c.ifaces = append(c.ifaces, *iface)
+	c.mu.Lock()
+	if !hasMembership(c.memberships, iface.Name, *gaddr) {
+		c.memberships = append(c.memberships, membership{IfaceName: iface.Name, Group: *gaddr})
+	}
+	c.ifaces = addIface(c.ifaces, *iface)
+	c.groups = addGroup(c.groups, *gaddr)
+	c.mu.Unlock()
+	return nil
+}
+
+// LeaveMulticastGroup leaves the multicast group gaddr on iface. It is the
+// inverse of JoinMulticastGroup.
+func (c *UDPConn) LeaveMulticastGroup(iface *net.Interface, gaddr *net.UDPAddr) error {
+	if iface == nil {
+		return errors.New("multicast: interface cannot be nil")
+	}
+	if gaddr == nil {
+		return errors.New("multicast: group address cannot be nil")
+	}
+
+	switch c.network {
+	case "udp4":
+		if err := c.ipv4conn.LeaveGroup(iface, gaddr); err != nil {
+			return err
+		}
+	case "udp6":
+		if err := c.ipv6conn.LeaveGroup(iface, gaddr); err != nil {
+			return err
+		}
+	default:
+		panic("unreachable")
+	}
+
+	c.mu.Lock()
+	c.memberships = removeMembership(c.memberships, iface.Name, *gaddr)
+	if !ifaceHasMembership(c.memberships, iface.Name) {
+		c.ifaces = removeIface(c.ifaces, *iface)
+	}
+	c.mu.Unlock()
 	return nil
 }
 
+// hasMembership reports whether (ifaceName, gaddr) is already recorded in
+// memberships.
+func hasMembership(memberships []membership, ifaceName string, gaddr net.UDPAddr) bool {
+	for _, m := range memberships {
+		if m.IfaceName == ifaceName && sameGroup(m.Group, gaddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeMembership removes the (ifaceName, gaddr) entry from memberships,
+// if present.
+func removeMembership(memberships []membership, ifaceName string, gaddr net.UDPAddr) []membership {
+	kept := memberships[:0]
+	for _, m := range memberships {
+		if m.IfaceName != ifaceName || !sameGroup(m.Group, gaddr) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// ifaceHasMembership reports whether ifaceName still has any group joined
+// on it.
+func ifaceHasMembership(memberships []membership, ifaceName string) bool {
+	for _, m := range memberships {
+		if m.IfaceName == ifaceName {
+			return true
+		}
+	}
+	return false
+}
+
+// groupHasMembership reports whether gaddr is still joined on any
+// interface.
+func groupHasMembership(memberships []membership, gaddr net.UDPAddr) bool {
+	for _, m := range memberships {
+		if sameGroup(m.Group, gaddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameGroup reports whether a and b are the same multicast group address.
+func sameGroup(a, b net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// addIface appends iface to ifaces if it isn't already present.
+func addIface(ifaces []net.Interface, iface net.Interface) []net.Interface {
+	for _, ifi := range ifaces {
+		if ifi.Name == iface.Name {
+			return ifaces
+		}
+	}
+	return append(ifaces, iface)
+}
+
+// addGroup appends gaddr to groups if it isn't already present.
+func addGroup(groups []net.UDPAddr, gaddr net.UDPAddr) []net.UDPAddr {
+	for _, g := range groups {
+		if sameGroup(g, gaddr) {
+			return groups
+		}
+	}
+	return append(groups, gaddr)
+}
+
+// removeIface removes iface (matched by name) from ifaces.
+func removeIface(ifaces []net.Interface, iface net.Interface) []net.Interface {
+	kept := ifaces[:0]
+	for _, ifi := range ifaces {
+		if ifi.Name != iface.Name {
+			kept = append(kept, ifi)
+		}
+	}
+	return kept
+}
+
+// removeGroup removes gaddr from groups.
+func removeGroup(groups []net.UDPAddr, gaddr net.UDPAddr) []net.UDPAddr {
+	kept := groups[:0]
+	for _, g := range groups {
+		if !sameGroup(g, gaddr) {
+			kept = append(kept, g)
+		}
+	}
+	return kept
+}
+
 // SetMulticastTTL sets the multicast TTL (IPv4) or hop limit (IPv6) used for
 // outbound multicast packets.
 func (c *UDPConn) SetMulticastTTL(ttl int) error {
@@ -215,6 +453,93 @@ func (c *UDPConn) WriteToMulticast(buf []byte, addr *net.UDPAddr) error {
 	}
 }
 
+// WriteBatchToMulticast sends msgs to the multicast address addr using all
+// joined interfaces, submitting each interface's burst with a single
+// sendmmsg(2)-style syscall instead of one sendto(2) per packet. It sets
+// Addr and OOB on every element of msgs, so callers only need to populate
+// Buffers before calling it; msgs may be reused across calls. The returned
+// count is the total number of messages written across all interfaces, and
+// any per-interface errors are aggregated and returned as a joined error.
+func (c *UDPConn) WriteBatchToMulticast(msgs []ipv4.Message, addr *net.UDPAddr) (int, error) {
+	if addr == nil {
+		return 0, errors.New("multicast: address cannot be nil")
+	}
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	var total int
+	var errs []error
+
+	ifaces := c.Interfaces()
+
+	switch c.network {
+	case "udp4":
+		for ifi := range ifaces {
+			var wcm ipv4.ControlMessage
+			switch runtime.GOOS {
+			case "darwin", "ios", "linux":
+				wcm.IfIndex = ifaces[ifi].Index
+			default:
+				if err := c.ipv4conn.SetMulticastInterface(&ifaces[ifi]); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
+			for i := range msgs {
+				msgs[i].Addr = addr
+				msgs[i].OOB = wcm.Marshal()
+			}
+			n, err := c.ipv4conn.WriteBatch(msgs, 0)
+			total += n
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	case "udp6":
+		for ifi := range ifaces {
+			var wcm ipv6.ControlMessage
+			switch runtime.GOOS {
+			case "darwin", "ios", "linux":
+				wcm.IfIndex = ifaces[ifi].Index
+			default:
+				if err := c.ipv6conn.SetMulticastInterface(&ifaces[ifi]); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
+			for i := range msgs {
+				msgs[i].Addr = addr
+				msgs[i].OOB = wcm.Marshal()
+			}
+			n, err := c.ipv6conn.WriteBatch(msgs, 0)
+			total += n
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	default:
+		panic("unreachable")
+	}
+
+	return total, errors.Join(errs...)
+}
+
+// ReadBatch reads a burst of incoming packets into msgs using a single
+// recvmmsg(2)-style syscall instead of one recvfrom(2) per packet, and
+// returns the number of messages filled in. flags is passed through to the
+// underlying ipv4.PacketConn.ReadBatch/ipv6.PacketConn.ReadBatch call.
+func (c *UDPConn) ReadBatch(msgs []ipv4.Message, flags int) (int, error) {
+	switch c.network {
+	case "udp4":
+		return c.ipv4conn.ReadBatch(msgs, flags)
+	case "udp6":
+		return c.ipv6conn.ReadBatch(msgs, flags)
+	default:
+		panic("unreachable")
+	}
+}
+
 func (c *UDPConn) joinIfaces(ifaces []net.Interface, gaddr *net.UDPAddr) (ok bool, err error) {
 	var errs error
 	var fails int
@@ -263,8 +588,191 @@ func (c *UDPConn) Interfaces() []net.Interface {
 	if c == nil {
 		return nil
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	// Return a copy to prevent external modification
 	ifaces := make([]net.Interface, len(c.ifaces))
 	copy(ifaces, c.ifaces)
 	return ifaces
 }
+
+// Groups returns a copy of the multicast group addresses this connection
+// has ever joined via JoinMulticastGroup, across any interface.
+func (c *UDPConn) Groups() []net.UDPAddr {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	groups := make([]net.UDPAddr, len(c.groups))
+	copy(groups, c.groups)
+	return groups
+}
+
+// ControlMessage carries per-packet receive metadata surfaced by
+// ReadFromMulticast: the destination (multicast group) address the packet
+// was sent to, the index of the interface it arrived on, and the TTL
+// (IPv4) or hop limit (IPv6) it was received with.
+type ControlMessage struct {
+	// Dst is the destination address of the packet, typically the
+	// multicast group address.
+	Dst net.IP
+	// IfIndex is the index of the interface the packet arrived on.
+	IfIndex int
+	// TTL is the IPv4 TTL or IPv6 hop limit the packet was received with.
+	TTL int
+}
+
+// ReadFromMulticast reads a packet into buf and returns, in addition to the
+// sender's address, the per-packet ControlMessage describing which group
+// address and interface the packet arrived on. This requires the kernel to
+// report IP_PKTINFO/IPV6_PKTINFO for every read, which ReadFromMulticast
+// enables on first use.
+//
+// It is used instead of ReadFrom when a caller needs to know which
+// interface a packet arrived on, for example an mDNS responder that must
+// reply only on the receiving interface.
+func (c *UDPConn) ReadFromMulticast(buf []byte) (n int, src *net.UDPAddr, cm *ControlMessage, err error) {
+	switch c.network {
+	case "udp4":
+		if err := c.ipv4conn.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface|ipv4.FlagTTL, true); err != nil {
+			return 0, nil, nil, err
+		}
+		n, rcm, rsrc, err := c.ipv4conn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if rcm != nil {
+			cm = &ControlMessage{Dst: rcm.Dst, IfIndex: rcm.IfIndex, TTL: rcm.TTL}
+		}
+		udpSrc, _ := rsrc.(*net.UDPAddr)
+		return n, udpSrc, cm, nil
+	case "udp6":
+		if err := c.ipv6conn.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface|ipv6.FlagHopLimit, true); err != nil {
+			return 0, nil, nil, err
+		}
+		n, rcm, rsrc, err := c.ipv6conn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if rcm != nil {
+			cm = &ControlMessage{Dst: rcm.Dst, IfIndex: rcm.IfIndex, TTL: rcm.HopLimit}
+		}
+		udpSrc, _ := rsrc.(*net.UDPAddr)
+		return n, udpSrc, cm, nil
+	default:
+		panic("unreachable")
+	}
+}
+
+// WriteToInterface sends buf as a unicast packet to addr, pinning the
+// outgoing interface to ifIndex (as reported by ControlMessage.IfIndex) via
+// the same per-packet control message mechanism WriteToMulticast uses for
+// multicast sends. It is used instead of the embedded net.UDPConn's
+// WriteToUDP when a reply must go out the interface a request arrived on
+// rather than whatever route the kernel's default unicast routing table
+// would pick, for example an mDNS responder replying to a query.
+func (c *UDPConn) WriteToInterface(buf []byte, addr *net.UDPAddr, ifIndex int) error {
+	switch c.network {
+	case "udp4":
+		wcm := ipv4.ControlMessage{IfIndex: ifIndex}
+		_, err := c.ipv4conn.WriteTo(buf, &wcm, addr)
+		return err
+	case "udp6":
+		wcm := ipv6.ControlMessage{IfIndex: ifIndex}
+		_, err := c.ipv6conn.WriteTo(buf, &wcm, addr)
+		return err
+	default:
+		panic("unreachable")
+	}
+}
+
+// JoinSourceSpecificGroup joins the source-specific multicast group gaddr,
+// restricted to packets originating from saddr, on iface. It fans the call
+// out across every joined interface when iface is nil.
+func (c *UDPConn) JoinSourceSpecificGroup(iface *net.Interface, gaddr, saddr *net.UDPAddr) error {
+	return c.eachIface(iface, func(ifi *net.Interface) error {
+		switch c.network {
+		case "udp4":
+			return c.ipv4conn.JoinSourceSpecificGroup(ifi, gaddr, saddr)
+		case "udp6":
+			return c.ipv6conn.JoinSourceSpecificGroup(ifi, gaddr, saddr)
+		default:
+			panic("unreachable")
+		}
+	})
+}
+
+// LeaveSourceSpecificGroup leaves the source-specific multicast group gaddr
+// for source saddr on iface, fanning the call out across every joined
+// interface when iface is nil.
+func (c *UDPConn) LeaveSourceSpecificGroup(iface *net.Interface, gaddr, saddr *net.UDPAddr) error {
+	return c.eachIface(iface, func(ifi *net.Interface) error {
+		switch c.network {
+		case "udp4":
+			return c.ipv4conn.LeaveSourceSpecificGroup(ifi, gaddr, saddr)
+		case "udp6":
+			return c.ipv6conn.LeaveSourceSpecificGroup(ifi, gaddr, saddr)
+		default:
+			panic("unreachable")
+		}
+	})
+}
+
+// ExcludeSourceSpecificGroup excludes saddr as a source for the
+// already-joined multicast group gaddr on iface, fanning the call out
+// across every joined interface when iface is nil.
+func (c *UDPConn) ExcludeSourceSpecificGroup(iface *net.Interface, gaddr, saddr *net.UDPAddr) error {
+	return c.eachIface(iface, func(ifi *net.Interface) error {
+		switch c.network {
+		case "udp4":
+			return c.ipv4conn.ExcludeSourceSpecificGroup(ifi, gaddr, saddr)
+		case "udp6":
+			return c.ipv6conn.ExcludeSourceSpecificGroup(ifi, gaddr, saddr)
+		default:
+			panic("unreachable")
+		}
+	})
+}
+
+// IncludeSourceSpecificGroup re-includes saddr as a source for the
+// already-joined multicast group gaddr on iface, fanning the call out
+// across every joined interface when iface is nil.
+func (c *UDPConn) IncludeSourceSpecificGroup(iface *net.Interface, gaddr, saddr *net.UDPAddr) error {
+	return c.eachIface(iface, func(ifi *net.Interface) error {
+		switch c.network {
+		case "udp4":
+			return c.ipv4conn.IncludeSourceSpecificGroup(ifi, gaddr, saddr)
+		case "udp6":
+			return c.ipv6conn.IncludeSourceSpecificGroup(ifi, gaddr, saddr)
+		default:
+			panic("unreachable")
+		}
+	})
+}
+
+// eachIface runs fn once for iface, or once per joined interface when iface
+// is nil, aggregating errors the same way joinIfaces does.
+func (c *UDPConn) eachIface(iface *net.Interface, fn func(*net.Interface) error) error {
+	if iface != nil {
+		return fn(iface)
+	}
+
+	ifaces := c.Interfaces()
+
+	var errs error
+	var fails int
+	for i := range ifaces {
+		if err := fn(&ifaces[i]); err != nil {
+			fails++
+			errs = errors.Join(errs, err)
+		}
+	}
+	if fails == len(ifaces) && fails > 0 {
+		return fmt.Errorf("multicast: failed on any interface: %w", errs)
+	}
+	if errs != nil {
+		return fmt.Errorf("multicast: failed on %d/%d interfaces: %w", fails, len(ifaces), errs)
+	}
+	return nil
+}